@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+)
+
+// pluginID identifies this plugin's own HTTP namespace, i.e. requests are
+// served under /plugins/<pluginID>/...
+const pluginID = "dice-roller"
+
+const (
+	actionReroll       = "reroll"
+	actionRerollLowest = "reroll-lowest"
+	actionKeepClose    = "keep-close"
+	actionExplain      = "explain"
+)
+
+// maxRollHistory bounds how many past rolls are kept in a post's audit
+// trail so repeated rerolling can't grow the message without limit.
+const maxRollHistory = 10
+
+// rollActionContext is round-tripped through a SlackAttachment action's
+// Context so the HTTP handler knows what to reroll and where to post the
+// result without having to look anything up from the post itself.
+type rollActionContext struct {
+	Expression string          `json:"expression"`
+	UserID     string          `json:"user_id"`
+	ChannelID  string          `json:"channel_id"`
+	RootID     string          `json:"root_id"`
+	History    []string        `json:"history"`
+	Snapshot   []tokenSnapshot `json:"snapshot,omitempty"`
+}
+
+// buildRollAttachment wires up the Reroll / Reroll lowest / Keep and close
+// round / Explain actions on a dice post, carrying enough context (the
+// audit trail so far, and a snapshot of the dice just rolled) for the HTTP
+// handlers to act without a lookup.
+func (p *Plugin) buildRollAttachment(expression, userID, channelID, rootID string, history []string, snapshot []tokenSnapshot) *model.SlackAttachment {
+	ctx := rollActionContext{Expression: expression, UserID: userID, ChannelID: channelID, RootID: rootID, History: history, Snapshot: snapshot}
+
+	action := func(id, name, endpoint string) *model.PostAction {
+		return &model.PostAction{
+			Id:   id,
+			Name: name,
+			Type: model.PostActionTypeButton,
+			Integration: &model.PostActionIntegration{
+				URL:     fmt.Sprintf("/plugins/%s/action/%s", pluginID, endpoint),
+				Context: structToMap(ctx),
+			},
+		}
+	}
+
+	return &model.SlackAttachment{
+		Actions: []*model.PostAction{
+			action("reroll", "Reroll", actionReroll),
+			action("reroll_lowest", "Reroll lowest", actionRerollLowest),
+			action("keep_close", "Keep and close round", actionKeepClose),
+			action("explain", "Explain", actionExplain),
+		},
+	}
+}
+
+// ServeHTTP implements the interactive-message webhook contract: Mattermost
+// posts a model.PostActionIntegrationRequest to the URL an action Button
+// was given, and expects a model.PostActionIntegrationResponse back.
+func (p *Plugin) ServeHTTP(_ *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case actionReroll:
+		p.handleRollAction(w, r, actionReroll)
+	case actionRerollLowest:
+		p.handleRollAction(w, r, actionRerollLowest)
+	case actionKeepClose:
+		p.handleKeepCloseAction(w, r)
+	case actionExplain:
+		p.handleExplainAction(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRollAction re-rolls the expression stored in the action's context,
+// then updates the original post with the new result appended to its audit
+// trail. For a plain reroll, every token is rolled fresh. For "reroll
+// lowest", each token is instead replayed from the post's stored snapshot
+// with just its own lowest kept die replaced, so the rest of that token's
+// dice are left exactly as they were last shown — a fresh snapshot of the
+// (possibly partially rerolled) result is captured either way, for the next
+// click to build on.
+func (p *Plugin) handleRollAction(w http.ResponseWriter, r *http.Request, action string) {
+	req, ctx, appErr := decodeActionRequest(r)
+	if appErr != nil {
+		writeActionError(w, appErr)
+		return
+	}
+
+	user, userErr := p.API.GetUser(req.UserId)
+	if userErr != nil {
+		writeActionError(w, userErr)
+		return
+	}
+	displayName := user.Nickname
+	if displayName == "" {
+		displayName = user.Username
+	}
+
+	source, seededWith, rngErr := p.newRNG()
+	if rngErr != nil {
+		writeActionError(w, appError(rngErr.Error(), rngErr))
+		return
+	}
+
+	var snapshot []tokenSnapshot
+	index := 0
+	roll := func(token string) (*rollResult, error) {
+		i := index
+		index++
+
+		var result *rollResult
+		var err error
+		switch {
+		case action == actionRerollLowest && i < len(ctx.Snapshot):
+			// A prior roll of this token is on record: replay it and
+			// reroll only its own lowest kept die in place.
+			result = rerollLowestDie(ctx.Snapshot[i].rollResult(), token, source)
+		case action == actionRerollLowest:
+			// No prior state for this token (e.g. a post from before roll
+			// snapshots existed): fall back to rolling it fresh.
+			result, err = rerollLowest(token, source)
+		default:
+			result, err = rollDice(token, source)
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, snapshotToken(token, result))
+		return result, nil
+	}
+
+	result, total, highestDie, evalErr := evaluateQuery(ctx.Expression, roll)
+	if evalErr != nil {
+		writeActionError(w, evalErr)
+		return
+	}
+
+	if recordErr := p.recordRoll(ctx.ChannelID, req.UserId, req.PostId, displayName, ctx.Expression, total, highestDie); recordErr != nil {
+		writeActionError(w, recordErr)
+		return
+	}
+	if seededWith != nil {
+		commitment := pendingCommitment{seed: seededWith.seed, expression: ctx.Expression, result: result}
+		if commitErr := p.recordCommitment(ctx.ChannelID, req.PostId, commitment); commitErr != nil {
+			writeActionError(w, commitErr)
+			return
+		}
+	}
+
+	entry := fmt.Sprintf("**%s** rolls *%s* = %s", displayName, ctx.Expression, result)
+	previous := ctx.History
+	ctx.History = appendRollHistory(ctx.History, entry)
+
+	post := &model.Post{
+		Id:        req.PostId,
+		UserId:    p.diceBotID,
+		ChannelId: ctx.ChannelID,
+		RootId:    ctx.RootID,
+		Message:   entry + auditTrail(previous),
+	}
+	post.AddProp("attachments", []*model.SlackAttachment{
+		p.buildRollAttachment(ctx.Expression, ctx.UserID, ctx.ChannelID, ctx.RootID, ctx.History, snapshot),
+	})
+
+	if _, err := p.API.UpdatePost(post); err != nil {
+		writeActionError(w, err)
+		return
+	}
+
+	writeActionResponse(w, &model.PostActionIntegrationResponse{Update: post})
+}
+
+// handleKeepCloseAction keeps the current roll as-is and closes the round,
+// reusing the same close post the /close command generates.
+func (p *Plugin) handleKeepCloseAction(w http.ResponseWriter, r *http.Request) {
+	req, ctx, appErr := decodeActionRequest(r)
+	if appErr != nil {
+		writeActionError(w, appErr)
+		return
+	}
+
+	closePost, closeErr := p.generateClosePost(req.UserId, ctx.ChannelID, ctx.RootID)
+	if closeErr != nil {
+		writeActionError(w, closeErr)
+		return
+	}
+	if _, err := p.API.CreatePost(closePost); err != nil {
+		writeActionError(w, err)
+		return
+	}
+
+	writeActionResponse(w, &model.PostActionIntegrationResponse{EphemeralText: "Round closed."})
+}
+
+// handleExplainAction sends the clicking user an ephemeral breakdown of the
+// roll actually shown on the post, replayed from its stored snapshot rather
+// than rolled fresh — rolling again would show dice that never happened.
+func (p *Plugin) handleExplainAction(w http.ResponseWriter, r *http.Request) {
+	_, ctx, appErr := decodeActionRequest(r)
+	if appErr != nil {
+		writeActionError(w, appErr)
+		return
+	}
+
+	if len(ctx.Snapshot) == 0 {
+		writeActionResponse(w, &model.PostActionIntegrationResponse{
+			EphemeralText: fmt.Sprintf("No recorded roll to explain for `%s` (this post predates roll snapshots).", ctx.Expression),
+		})
+		return
+	}
+
+	index := 0
+	result, _, _, evalErr := evaluateQuery(ctx.Expression, func(token string) (*rollResult, error) {
+		i := index
+		index++
+		if i >= len(ctx.Snapshot) {
+			return nil, fmt.Errorf("no recorded roll for %q", token)
+		}
+		return ctx.Snapshot[i].rollResult(), nil
+	})
+	if evalErr != nil {
+		writeActionError(w, evalErr)
+		return
+	}
+
+	writeActionResponse(w, &model.PostActionIntegrationResponse{
+		EphemeralText: fmt.Sprintf("`%s` breaks down as: %s", ctx.Expression, result),
+	})
+}
+
+func decodeActionRequest(r *http.Request) (*model.PostActionIntegrationRequest, *rollActionContext, *model.AppError) {
+	var req model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, nil, appError("Could not decode action request: "+err.Error(), err)
+	}
+
+	raw, marshalErr := json.Marshal(req.Context)
+	if marshalErr != nil {
+		return nil, nil, appError("Could not decode action context: "+marshalErr.Error(), marshalErr)
+	}
+	var ctx rollActionContext
+	if err := json.Unmarshal(raw, &ctx); err != nil {
+		return nil, nil, appError("Could not decode action context: "+err.Error(), err)
+	}
+	return &req, &ctx, nil
+}
+
+func writeActionResponse(w http.ResponseWriter, response *model.PostActionIntegrationResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func writeActionError(w http.ResponseWriter, err *model.AppError) {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// structToMap round-trips v through JSON so it can be stored as a
+// model.PostAction's Context, which Mattermost requires to be a plain
+// map[string]interface{}.
+func structToMap(v interface{}) map[string]interface{} {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// appendRollHistory appends entry to history, trimming from the front once
+// maxRollHistory is exceeded.
+func appendRollHistory(history []string, entry string) []string {
+	history = append(history, entry)
+	if len(history) > maxRollHistory {
+		history = history[len(history)-maxRollHistory:]
+	}
+	return history
+}
+
+// auditTrail renders prior rolls underneath the latest one, oldest first.
+func auditTrail(previous []string) string {
+	trail := ""
+	for _, line := range previous {
+		trail += "\n> " + line
+	}
+	return trail
+}
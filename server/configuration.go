@@ -0,0 +1,59 @@
+package main
+
+import "fmt"
+
+// configuration captures the plugin's System Console settings.
+type configuration struct {
+	// TieBreaker decides how `/close` ranks tied round totals: "highest_die"
+	// (default, highest single die rolled this round wins), "first_roll"
+	// (whoever rolled first this round wins), or "reroll_off" (ties are left
+	// for the players to settle with a reroll).
+	TieBreaker string
+
+	// RNGBackend selects the source of randomness rolls are drawn from:
+	// "fast" (default, math/rand) for casual play, or "crypto" to draw each
+	// roll from crypto/rand and commit to it so it can later be checked
+	// with `/roll verify` for competitive or verifiable play.
+	RNGBackend string
+}
+
+// Clone returns a shallow copy of the configuration.
+func (c *configuration) Clone() *configuration {
+	clone := *c
+	return &clone
+}
+
+// getConfiguration retrieves the active configuration under lock, making it
+// safe to use concurrently. The active configuration may change underneath
+// the client of this method, but the struct returned by this API call is
+// never modified after it is returned.
+func (p *Plugin) getConfiguration() *configuration {
+	p.configurationLock.RLock()
+	defer p.configurationLock.RUnlock()
+
+	if p.configuration == nil {
+		return &configuration{}
+	}
+
+	return p.configuration
+}
+
+// setConfiguration replaces the active configuration under lock.
+func (p *Plugin) setConfiguration(configuration *configuration) {
+	p.configurationLock.Lock()
+	defer p.configurationLock.Unlock()
+
+	p.configuration = configuration
+}
+
+// OnConfigurationChange is invoked when configuration changes may have been made.
+func (p *Plugin) OnConfigurationChange() error {
+	configuration := new(configuration)
+
+	if err := p.API.LoadPluginConfiguration(configuration); err != nil {
+		return fmt.Errorf("failed to load plugin configuration: %w", err)
+	}
+
+	p.setConfiguration(configuration)
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rollType identifies the shape of a parsed dice expression so that
+// generateDicePost knows how to fold it into the running total.
+type rollType int
+
+const (
+	// numeric is a roll of one or more dice (possibly exploding, kept,
+	// dropped or rerolled) whose kept values are summed.
+	numeric rollType = iota
+	// modifier is a flat `+N` / `-N` token added directly to the total.
+	modifier
+	// pool is a World-of-Darkness style success pool: dice are not
+	// summed, they are counted against a target number instead.
+	pool
+)
+
+// maxExplosions caps the number of extra dice an exploding die can add to
+// its own chain, so a run of `!` matches can't roll forever.
+const maxExplosions = 100
+
+// dieResult is the outcome of a single die, including the bookkeeping
+// generateDicePost needs to render kept/dropped/exploded markers.
+type dieResult struct {
+	value    int // final value of this die, including its exploded chain
+	chain    []int
+	dropped  bool
+	rerolled bool
+}
+
+// rollResult is the outcome of parsing and evaluating a single dice
+// expression (one whitespace-separated token passed to rollDice).
+type rollResult struct {
+	rollType    rollType
+	dice        []dieResult
+	results     []int // kept die values, flattened for callers that don't care about drops
+	sumModifier int   // flat value: the whole token when rollType == modifier, or a numeric roll's trailing +N/-N
+	successes   int   // success count when rollType == pool
+}
+
+var (
+	modifierPattern = regexp.MustCompile(`^([+-]\d+)$`)
+	numberPattern   = regexp.MustCompile(`^(\d+)$`)
+	dicePattern     = regexp.MustCompile(`^(\d*)[dD]([fF]|\d+)(!)?((?:[kK][hHlL]|[dD][hHlL])\d+)?([rR]\d+)?([sS]\d+)?([+-]\d+)?$`)
+)
+
+// rollDice parses a single dice-notation token and evaluates it.
+//
+// It accepts plain numbers ("20"), flat modifiers ("+3"), classic NdM
+// rolls ("4d6", "4d6+2"), exploding dice ("4d6!"), keep/drop ("4d6kh3",
+// "4d6dl1"), reroll-once ("2d20r1"), advantage/disadvantage shortcuts
+// ("adv", "dis") and Fate/FUDGE dice ("4dF").
+func rollDice(token string, r rng) (*rollResult, error) {
+	switch token {
+	case "adv":
+		token = "2d20kh1"
+	case "dis":
+		token = "2d20kl1"
+	}
+
+	if modifierPattern.MatchString(token) {
+		value, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid modifier", token)
+		}
+		return &rollResult{rollType: modifier, sumModifier: value}, nil
+	}
+
+	if numberPattern.MatchString(token) {
+		sides, err := strconv.Atoi(token)
+		if err != nil || sides < 1 {
+			return nil, fmt.Errorf("%q is not a valid number of sides", token)
+		}
+		return rollDice(fmt.Sprintf("1d%d", sides), r)
+	}
+
+	matches := dicePattern.FindStringSubmatch(token)
+	if matches == nil {
+		return nil, fmt.Errorf("%q is not a valid dice expression", token)
+	}
+
+	count := 1
+	if matches[1] != "" {
+		var err error
+		count, err = strconv.Atoi(matches[1])
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("%q has an invalid dice count", token)
+		}
+	}
+	if count > 1000 {
+		return nil, fmt.Errorf("%q asks for too many dice (max 1000)", token)
+	}
+
+	sidesToken := matches[2]
+	explode := matches[3] != ""
+	keepDrop := matches[4]
+	reroll := matches[5]
+	success := matches[6]
+	trailingModifier := matches[7]
+
+	if sidesToken == "f" || sidesToken == "F" {
+		if explode || keepDrop != "" || reroll != "" || success != "" {
+			return nil, fmt.Errorf("%q cannot combine Fate dice with !, kh/kl/dh/dl, r or s", token)
+		}
+		return rollFateDice(count, trailingModifier, r)
+	}
+
+	sides, err := strconv.Atoi(sidesToken)
+	if err != nil || sides < 1 {
+		return nil, fmt.Errorf("%q has an invalid number of sides", token)
+	}
+
+	if success != "" {
+		if explode || keepDrop != "" || reroll != "" {
+			return nil, fmt.Errorf("%q cannot combine a success pool (s) with !, kh/kl/dh/dl or r", token)
+		}
+		target, err := strconv.Atoi(success[1:])
+		if err != nil || target < 1 {
+			return nil, fmt.Errorf("%q has an invalid success target", token)
+		}
+		return rollPool(count, sides, target, r), nil
+	}
+
+	rerollThreshold := 0
+	if reroll != "" {
+		rerollThreshold, err = strconv.Atoi(reroll[1:])
+		if err != nil || rerollThreshold < 1 {
+			return nil, fmt.Errorf("%q has an invalid reroll threshold", token)
+		}
+	}
+
+	dice := make([]dieResult, count)
+	for i := range dice {
+		value := 1 + r.Intn(sides)
+		if rerollThreshold > 0 && value <= rerollThreshold {
+			value = 1 + r.Intn(sides)
+			dice[i].rerolled = true
+		}
+		chain := []int{value}
+		explosions := 0
+		for explode && value == sides && explosions < maxExplosions {
+			value = 1 + r.Intn(sides)
+			chain = append(chain, value)
+			explosions++
+		}
+		sum := 0
+		for _, v := range chain {
+			sum += v
+		}
+		dice[i].value = sum
+		dice[i].chain = chain
+	}
+
+	if keepDrop != "" {
+		if err := applyKeepDrop(dice, keepDrop, token); err != nil {
+			return nil, err
+		}
+	}
+
+	modifierValue := 0
+	if trailingModifier != "" {
+		modifierValue, err = strconv.Atoi(trailingModifier)
+		if err != nil {
+			return nil, fmt.Errorf("%q has an invalid trailing modifier", token)
+		}
+	}
+
+	return finishNumericRoll(dice, modifierValue), nil
+}
+
+// applyKeepDrop marks the dice that fall outside the requested
+// keep-highest/keep-lowest/drop-highest/drop-lowest selection as dropped.
+func applyKeepDrop(dice []dieResult, keepDrop, token string) error {
+	mode := keepDrop[:2]
+	n, err := strconv.Atoi(keepDrop[2:])
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q has an invalid keep/drop count", token)
+	}
+	if n > len(dice) {
+		n = len(dice)
+	}
+
+	order := make([]int, len(dice))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return dice[order[i]].value < dice[order[j]].value
+	})
+
+	drop := func(indexes []int) {
+		for _, i := range indexes {
+			dice[i].dropped = true
+		}
+	}
+
+	switch mode {
+	case "kh", "Kh", "KH", "kH":
+		drop(order[:len(order)-n])
+	case "kl", "Kl", "KL", "kL":
+		drop(order[n:])
+	case "dh", "Dh", "DH", "dH":
+		drop(order[len(order)-n:])
+	case "dl", "Dl", "DL", "dL":
+		drop(order[:n])
+	default:
+		return fmt.Errorf("%q has an unknown keep/drop mode %q", token, mode)
+	}
+	return nil
+}
+
+// finishNumericRoll sums the kept dice and the trailing modifier into a
+// rollResult ready for generateDicePost to render.
+func finishNumericRoll(dice []dieResult, modifierValue int) *rollResult {
+	result := &rollResult{rollType: numeric, dice: dice, sumModifier: modifierValue}
+	for _, die := range dice {
+		if !die.dropped {
+			result.results = append(result.results, die.value)
+		}
+	}
+	return result
+}
+
+// rollFateDice rolls count Fate/FUDGE dice, each landing on -1, 0 or +1.
+func rollFateDice(count int, trailingModifier string, r rng) (*rollResult, error) {
+	dice := make([]dieResult, count)
+	for i := range dice {
+		dice[i].value = r.Intn(3) - 1
+		dice[i].chain = []int{dice[i].value}
+	}
+	modifierValue := 0
+	if trailingModifier != "" {
+		var err error
+		modifierValue, err = strconv.Atoi(trailingModifier)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trailing modifier %q", trailingModifier)
+		}
+	}
+	return finishNumericRoll(dice, modifierValue), nil
+}
+
+// formatDice renders a slice of dieResult as markdown, striking through
+// dropped dice and showing exploded chains as "first+extra+extra".
+func formatDice(dice []dieResult) string {
+	parts := make([]string, len(dice))
+	for i, die := range dice {
+		chain := make([]string, len(die.chain))
+		for j, v := range die.chain {
+			chain[j] = strconv.Itoa(v)
+		}
+		display := strings.Join(chain, "+")
+		if die.rerolled {
+			display += "r"
+		}
+		if die.dropped {
+			display = "~~" + display + "~~"
+		}
+		parts[i] = display
+	}
+	return strings.Join(parts, " ")
+}
+
+// rerollLowest evaluates token like rollDice, then rerolls just the single
+// lowest-valued kept die in place, leaving the rest of the roll untouched.
+// It backs the "Reroll lowest" interactive action when no prior roll state
+// is available to replay (e.g. a post created before roll snapshots existed).
+func rerollLowest(token string, r rng) (*rollResult, error) {
+	result, err := rollDice(token, r)
+	if err != nil {
+		return nil, err
+	}
+	return rerollLowestDie(result, token, r), nil
+}
+
+// rerollLowestDie rerolls just the single lowest-valued kept die of an
+// already-evaluated result in place, leaving every other die untouched. It
+// is shared by rerollLowest (which rolls token fresh first) and the
+// snapshot-replaying "Reroll lowest" action handler, which instead hands it
+// the dice as they were last shown on the post. Flat modifiers, success
+// pools and Fate dice are returned unchanged.
+func rerollLowestDie(result *rollResult, token string, r rng) *rollResult {
+	if result.rollType != numeric || len(result.dice) == 0 {
+		return result
+	}
+
+	// Plain numbers and the adv/dis shortcuts are rewritten the same way
+	// rollDice rewrites them, so their die size can be read below.
+	switch {
+	case token == "adv" || token == "dis":
+		token = "2d20"
+	case numberPattern.MatchString(token):
+		token = "1d" + token
+	}
+
+	matches := dicePattern.FindStringSubmatch(token)
+	if matches == nil || matches[2] == "f" || matches[2] == "F" {
+		return result
+	}
+	sides, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return result
+	}
+
+	lowest := -1
+	for i, die := range result.dice {
+		if die.dropped {
+			continue
+		}
+		if lowest == -1 || die.value < result.dice[lowest].value {
+			lowest = i
+		}
+	}
+	if lowest == -1 {
+		return result
+	}
+
+	value := 1 + r.Intn(sides)
+	result.dice[lowest] = dieResult{value: value, chain: []int{value}, rerolled: true}
+
+	result.results = nil
+	for _, die := range result.dice {
+		if !die.dropped {
+			result.results = append(result.results, die.value)
+		}
+	}
+	return result
+}
+
+// diceSnapshot is a JSON-serializable mirror of dieResult, persisted in a
+// roll's action context so a later "Reroll lowest" or "Explain" click can
+// work from the dice as they were actually shown, instead of rolling fresh.
+type diceSnapshot struct {
+	Value    int   `json:"value"`
+	Chain    []int `json:"chain"`
+	Dropped  bool  `json:"dropped"`
+	Rerolled bool  `json:"rerolled"`
+}
+
+// tokenSnapshot is a JSON-serializable mirror of one token's rollResult.
+type tokenSnapshot struct {
+	Token       string         `json:"token"`
+	RollType    rollType       `json:"roll_type"`
+	Dice        []diceSnapshot `json:"dice"`
+	SumModifier int            `json:"sum_modifier"`
+	Successes   int            `json:"successes"`
+}
+
+// snapshotToken captures result, the evaluation of token, for later replay.
+func snapshotToken(token string, result *rollResult) tokenSnapshot {
+	dice := make([]diceSnapshot, len(result.dice))
+	for i, die := range result.dice {
+		dice[i] = diceSnapshot{Value: die.value, Chain: die.chain, Dropped: die.dropped, Rerolled: die.rerolled}
+	}
+	return tokenSnapshot{
+		Token:       token,
+		RollType:    result.rollType,
+		Dice:        dice,
+		SumModifier: result.sumModifier,
+		Successes:   result.successes,
+	}
+}
+
+// rollResult reconstructs the rollResult snapshotToken captured, without
+// drawing any new randomness.
+func (t tokenSnapshot) rollResult() *rollResult {
+	dice := make([]dieResult, len(t.Dice))
+	var results []int
+	for i, d := range t.Dice {
+		dice[i] = dieResult{value: d.Value, chain: d.Chain, dropped: d.Dropped, rerolled: d.Rerolled}
+		if !d.Dropped {
+			results = append(results, d.Value)
+		}
+	}
+	return &rollResult{rollType: t.RollType, dice: dice, results: results, sumModifier: t.SumModifier, successes: t.Successes}
+}
+
+// rollPool rolls a World-of-Darkness style success pool: count dice of
+// sides, each die at or above target counts as one success.
+func rollPool(count, sides, target int, r rng) *rollResult {
+	dice := make([]dieResult, count)
+	successes := 0
+	for i := range dice {
+		value := 1 + r.Intn(sides)
+		dice[i].value = value
+		dice[i].chain = []int{value}
+		if value >= target {
+			successes++
+		}
+	}
+	return &rollResult{rollType: pool, dice: dice, successes: successes}
+}
@@ -0,0 +1,220 @@
+package main
+
+import "testing"
+
+// stepRNG returns Intn results from a fixed sequence, so a token's dice can
+// be pinned down for assertions instead of asserting only on shape.
+type stepRNG struct {
+	values []int
+	i      int
+}
+
+func (s *stepRNG) Intn(n int) int {
+	v := s.values[s.i]
+	s.i++
+	return v
+}
+
+func TestRollDiceTokens(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		rngValues    []int
+		wantType     rollType
+		wantResults  []int
+		wantModifier int
+		wantSuccess  int
+		wantDropped  []bool
+	}{
+		{
+			name:        "plain number",
+			token:       "20",
+			rngValues:   []int{7},
+			wantType:    numeric,
+			wantResults: []int{8},
+		},
+		{
+			name:         "positive modifier",
+			token:        "+3",
+			wantType:     modifier,
+			wantModifier: 3,
+		},
+		{
+			name:         "negative modifier",
+			token:        "-2",
+			wantType:     modifier,
+			wantModifier: -2,
+		},
+		{
+			name:        "NdM",
+			token:       "4d6",
+			rngValues:   []int{0, 1, 2, 3},
+			wantType:    numeric,
+			wantResults: []int{1, 2, 3, 4},
+		},
+		{
+			name:         "NdM with trailing modifier",
+			token:        "4d6+2",
+			rngValues:    []int{0, 1, 2, 3},
+			wantType:     numeric,
+			wantResults:  []int{1, 2, 3, 4},
+			wantModifier: 2,
+		},
+		{
+			name:        "exploding die",
+			token:       "1d6!",
+			rngValues:   []int{5, 2}, // first roll maxes out (value 6), explodes once more to 3
+			wantType:    numeric,
+			wantResults: []int{9}, // 6 + 3
+		},
+		{
+			name:        "keep highest",
+			token:       "4d6kh3",
+			rngValues:   []int{0, 5, 2, 1}, // values 1 6 3 2 -> keep top three, drop the 1
+			wantType:    numeric,
+			wantResults: []int{6, 3, 2},
+			wantDropped: []bool{true, false, false, false},
+		},
+		{
+			name:        "drop lowest",
+			token:       "4d6dl1",
+			rngValues:   []int{0, 5, 2, 1}, // values 1 6 3 2 -> drop the 1
+			wantType:    numeric,
+			wantResults: []int{6, 3, 2},
+			wantDropped: []bool{true, false, false, false},
+		},
+		{
+			name:        "reroll once below threshold",
+			token:       "2d20r1",
+			rngValues:   []int{0, 10, 15}, // first die rolls 1 (<=1), rerolled to 11; second die rolls 16
+			wantType:    numeric,
+			wantResults: []int{11, 16},
+		},
+		{
+			name:        "advantage shortcut",
+			token:       "adv",
+			rngValues:   []int{9, 14}, // 2d20kh1: 10 and 15, keep the 15
+			wantType:    numeric,
+			wantResults: []int{15},
+		},
+		{
+			name:        "disadvantage shortcut",
+			token:       "dis",
+			rngValues:   []int{9, 14}, // 2d20kl1: 10 and 15, keep the 10
+			wantType:    numeric,
+			wantResults: []int{10},
+		},
+		{
+			name:        "success pool",
+			token:       "6d10s8",
+			rngValues:   []int{7, 0, 9, 7, 2, 8}, // values 8 1 10 8 3 9 -> 4 at or above 8
+			wantType:    pool,
+			wantSuccess: 4,
+		},
+		{
+			name:        "fate dice",
+			token:       "4dF",
+			rngValues:   []int{0, 1, 2, 0}, // -1 0 1 -1
+			wantType:    numeric,
+			wantResults: []int{-1, 0, 1, -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := rollDice(tt.token, &stepRNG{values: tt.rngValues})
+			if err != nil {
+				t.Fatalf("rollDice(%q) returned error: %v", tt.token, err)
+			}
+			if result.rollType != tt.wantType {
+				t.Fatalf("rollDice(%q).rollType = %v, want %v", tt.token, result.rollType, tt.wantType)
+			}
+			if tt.wantResults != nil && !equalInts(result.results, tt.wantResults) {
+				t.Fatalf("rollDice(%q).results = %v, want %v", tt.token, result.results, tt.wantResults)
+			}
+			if result.sumModifier != tt.wantModifier {
+				t.Fatalf("rollDice(%q).sumModifier = %d, want %d", tt.token, result.sumModifier, tt.wantModifier)
+			}
+			if result.successes != tt.wantSuccess {
+				t.Fatalf("rollDice(%q).successes = %d, want %d", tt.token, result.successes, tt.wantSuccess)
+			}
+			if tt.wantDropped != nil {
+				for i, dropped := range tt.wantDropped {
+					if result.dice[i].dropped != dropped {
+						t.Fatalf("rollDice(%q).dice[%d].dropped = %v, want %v", tt.token, i, result.dice[i].dropped, dropped)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRollDiceInvalidTokens(t *testing.T) {
+	tests := []string{
+		"",
+		"abc",
+		"0d6",
+		"4d0",
+		"4d6xyz",
+		"4dFkh1",  // Fate dice can't combine with keep/drop
+		"4d6s8!",  // success pool can't combine with explode
+		"4d6kh-1", // negative keep count
+		"4d",      // missing sides
+	}
+	for _, token := range tests {
+		t.Run(token, func(t *testing.T) {
+			if _, err := rollDice(token, &stepRNG{values: make([]int, 10)}); err == nil {
+				t.Fatalf("rollDice(%q) expected an error, got none", token)
+			}
+		})
+	}
+}
+
+func TestRerollLowestDieReplacesOnlyTheLowestKeptDie(t *testing.T) {
+	result, err := rollDice("4d6", &stepRNG{values: []int{5, 0, 4, 2}}) // values 6 1 5 3
+	if err != nil {
+		t.Fatalf("rollDice returned error: %v", err)
+	}
+
+	rerolled := rerollLowestDie(result, "4d6", &stepRNG{values: []int{3}}) // new value 4
+	if !equalInts(rerolled.results, []int{6, 4, 5, 3}) {
+		t.Fatalf("rerollLowestDie results = %v, want [6 4 5 3]", rerolled.results)
+	}
+	if !rerolled.dice[1].rerolled {
+		t.Fatalf("expected the lowest die (index 1) to be marked rerolled")
+	}
+}
+
+func TestSnapshotTokenRoundTrip(t *testing.T) {
+	result, err := rollDice("3d6!kh2", &stepRNG{values: []int{5, 3, 1, 2}}) // first die explodes
+	if err != nil {
+		t.Fatalf("rollDice returned error: %v", err)
+	}
+
+	snapshot := snapshotToken("3d6!kh2", result)
+	restored := snapshot.rollResult()
+
+	if !equalInts(restored.results, result.results) {
+		t.Fatalf("restored.results = %v, want %v", restored.results, result.results)
+	}
+	if len(restored.dice) != len(result.dice) {
+		t.Fatalf("restored.dice has %d entries, want %d", len(restored.dice), len(result.dice))
+	}
+	for i := range result.dice {
+		if restored.dice[i].value != result.dice[i].value || restored.dice[i].dropped != result.dice[i].dropped {
+			t.Fatalf("restored.dice[%d] = %+v, want %+v", i, restored.dice[i], result.dice[i])
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
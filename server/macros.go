@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const (
+	userMacroKeyPrefix    = "macros_user_"
+	channelMacroKeyPrefix = "macros_channel_"
+	maxMacroDepth         = 10
+)
+
+// macroSet is the persisted shape of a user's or channel's saved rolls,
+// keyed by macro name (without the leading @).
+type macroSet map[string]string
+
+func (p *Plugin) userMacros(userID string) (macroSet, *model.AppError) {
+	return p.loadMacros(userMacroKeyPrefix + userID)
+}
+
+func (p *Plugin) channelMacros(channelID string) (macroSet, *model.AppError) {
+	return p.loadMacros(channelMacroKeyPrefix + channelID)
+}
+
+func (p *Plugin) loadMacros(key string) (macroSet, *model.AppError) {
+	data, err := p.API.KVGet(key)
+	if err != nil {
+		return nil, err
+	}
+	macros := macroSet{}
+	if data != nil {
+		if jsonErr := json.Unmarshal(data, &macros); jsonErr != nil {
+			return nil, appError("Stored macros are corrupted: "+jsonErr.Error(), jsonErr)
+		}
+	}
+	return macros, nil
+}
+
+func (p *Plugin) saveMacros(key string, macros macroSet) *model.AppError {
+	data, jsonErr := json.Marshal(macros)
+	if jsonErr != nil {
+		return appError("Could not encode macros: "+jsonErr.Error(), jsonErr)
+	}
+	return p.API.KVSet(key, data)
+}
+
+// saveMacro persists expression under name, scoped to userID unless
+// channelWide is set, in which case it is shared by the whole channel and
+// requires channel management permission.
+func (p *Plugin) saveMacro(userID, channelID, name, expression string, channelWide bool) *model.AppError {
+	key := userMacroKeyPrefix + userID
+	if channelWide {
+		if !p.API.HasPermissionToChannel(userID, channelID, model.PermissionManagePublicChannelProperties) {
+			return appError("You need channel management permissions to save a channel-wide roll.", nil)
+		}
+		key = channelMacroKeyPrefix + channelID
+	}
+
+	macros, err := p.loadMacros(key)
+	if err != nil {
+		return err
+	}
+	macros[name] = expression
+	return p.saveMacros(key, macros)
+}
+
+// unsaveMacro removes a personal saved roll, reporting whether it existed.
+func (p *Plugin) unsaveMacro(userID, name string) (bool, *model.AppError) {
+	key := userMacroKeyPrefix + userID
+	macros, err := p.loadMacros(key)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := macros[name]; !ok {
+		return false, nil
+	}
+	delete(macros, name)
+	return true, p.saveMacros(key, macros)
+}
+
+// listMacros renders every saved roll visible to userID in channelID as a
+// markdown bullet list, personal rolls first.
+func (p *Plugin) listMacros(userID, channelID string) (string, *model.AppError) {
+	user, err := p.userMacros(userID)
+	if err != nil {
+		return "", err
+	}
+	channel, err := p.channelMacros(channelID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(user) == 0 && len(channel) == 0 {
+		return "No saved rolls yet. Use `/roll save <name> <expression>` to create one.", nil
+	}
+
+	var lines []string
+	for _, name := range sortedMacroNames(user) {
+		lines = append(lines, fmt.Sprintf("- `%s` = `%s` (personal)", name, user[name]))
+	}
+	for _, name := range sortedMacroNames(channel) {
+		lines = append(lines, fmt.Sprintf("- `%s` = `%s` (channel)", name, channel[name]))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func sortedMacroNames(macros macroSet) []string {
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleMacroSubcommand recognizes the save/list/unsave subcommands of
+// /roll and executes them, reporting whether query was one of them so the
+// caller knows not to treat it as a dice expression.
+func (p *Plugin) handleMacroSubcommand(query, userID, channelID string) (bool, *model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false, nil, nil
+	}
+
+	switch fields[0] {
+	case "save":
+		rest := fields[1:]
+		channelWide := false
+		if len(rest) > 0 && rest[0] == "--channel" {
+			channelWide = true
+			rest = rest[1:]
+		}
+		if len(rest) < 2 {
+			return true, nil, appError("Usage: `/roll save [--channel] <name> <expression>`.", nil)
+		}
+		name, expression := rest[0], strings.Join(rest[1:], " ")
+		if err := p.saveMacro(userID, channelID, name, expression, channelWide); err != nil {
+			return true, nil, err
+		}
+		scope := "personal"
+		if channelWide {
+			scope = "channel"
+		}
+		return true, ephemeralResponse(fmt.Sprintf("Saved %s roll `%s` = `%s`.", scope, name, expression)), nil
+
+	case "list":
+		list, err := p.listMacros(userID, channelID)
+		if err != nil {
+			return true, nil, err
+		}
+		return true, ephemeralResponse(list), nil
+
+	case "unsave":
+		if len(fields) != 2 {
+			return true, nil, appError("Usage: `/roll unsave <name>`.", nil)
+		}
+		removed, err := p.unsaveMacro(userID, fields[1])
+		if err != nil {
+			return true, nil, err
+		}
+		if !removed {
+			return true, nil, appError(fmt.Sprintf("No saved roll named %q.", fields[1]), nil)
+		}
+		return true, ephemeralResponse(fmt.Sprintf("Removed `%s`.", fields[1])), nil
+	}
+
+	return false, nil, nil
+}
+
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+// expandMacros replaces every saved-roll reference in query (written as
+// "@name", or as a bare "name" when it is the whole token) with its stored
+// expression. Personal rolls take precedence over channel rolls of the same
+// name. References are resolved recursively up to maxMacroDepth levels deep,
+// and a macro that refers back to itself along its own resolution path,
+// directly or through another macro, is reported as an error rather than
+// looping forever. A macro referenced more than once along independent
+// branches (e.g. two sibling tokens, or a diamond of shared sub-macros) is
+// not a cycle and resolves normally.
+func (p *Plugin) expandMacros(userID, channelID, query string) (string, *model.AppError) {
+	user, err := p.userMacros(userID)
+	if err != nil {
+		return "", err
+	}
+	channel, err := p.channelMacros(channelID)
+	if err != nil {
+		return "", err
+	}
+
+	lookup := func(name string) (string, bool) {
+		if expression, ok := user[name]; ok {
+			return expression, true
+		}
+		expression, ok := channel[name]
+		return expression, ok
+	}
+
+	var resolve func(name string, seen map[string]bool, depth int) (string, error)
+	resolve = func(name string, seen map[string]bool, depth int) (string, error) {
+		if depth > maxMacroDepth {
+			return "", fmt.Errorf("%q is nested too deeply", name)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("%q refers back to itself", name)
+		}
+		expression, ok := lookup(name)
+		if !ok {
+			return "", fmt.Errorf("no saved roll named %q", name)
+		}
+		seen[name] = true
+		defer delete(seen, name)
+
+		tokens := strings.Fields(expression)
+		resolved := make([]string, len(tokens))
+		for i, token := range tokens {
+			if strings.HasPrefix(token, "@") {
+				expanded, resolveErr := resolve(token[1:], seen, depth+1)
+				if resolveErr != nil {
+					return "", resolveErr
+				}
+				resolved[i] = expanded
+				continue
+			}
+			resolved[i] = token
+		}
+		return strings.Join(resolved, " "), nil
+	}
+
+	tokens := strings.Fields(query)
+	resolved := make([]string, len(tokens))
+	for i, token := range tokens {
+		name := strings.TrimPrefix(token, "@")
+		if _, ok := lookup(name); !ok {
+			resolved[i] = token
+			continue
+		}
+		expanded, resolveErr := resolve(name, map[string]bool{}, 0)
+		if resolveErr != nil {
+			return "", appError(fmt.Sprintf("Could not expand %q: %s", token, resolveErr.Error()), resolveErr)
+		}
+		resolved[i] = expanded
+	}
+	return strings.Join(resolved, " "), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin"
+)
+
+// macroTestAPI is a minimal plugin.API fake backing only the KV calls
+// expandMacros exercises. It embeds a nil plugin.API to satisfy the rest of
+// the interface; calling any method not defined here panics.
+type macroTestAPI struct {
+	plugin.API
+	kv map[string][]byte
+}
+
+func newMacroTestAPI() *macroTestAPI { return &macroTestAPI{kv: map[string][]byte{}} }
+
+func (a *macroTestAPI) RegisterCommand(*model.Command) error          { return nil }
+func (a *macroTestAPI) GetUser(string) (*model.User, *model.AppError) { return nil, nil }
+func (a *macroTestAPI) CreatePost(*model.Post) (*model.Post, *model.AppError) {
+	return nil, nil
+}
+func (a *macroTestAPI) UpdatePost(*model.Post) (*model.Post, *model.AppError) {
+	return nil, nil
+}
+func (a *macroTestAPI) KVGet(key string) ([]byte, *model.AppError) { return a.kv[key], nil }
+func (a *macroTestAPI) KVSet(key string, value []byte) *model.AppError {
+	a.kv[key] = value
+	return nil
+}
+func (a *macroTestAPI) KVDelete(key string) *model.AppError {
+	delete(a.kv, key)
+	return nil
+}
+func (a *macroTestAPI) HasPermissionToChannel(string, string, *model.Permission) bool { return true }
+func (a *macroTestAPI) LoadPluginConfiguration(interface{}) error                     { return nil }
+
+func newTestPluginWithMacros(t *testing.T, userID string, macros macroSet) (*Plugin, *macroTestAPI) {
+	t.Helper()
+	api := newMacroTestAPI()
+	data, err := json.Marshal(macros)
+	if err != nil {
+		t.Fatalf("could not encode fixture macros: %v", err)
+	}
+	api.kv[userMacroKeyPrefix+userID] = data
+
+	p := &Plugin{}
+	p.API = api
+	return p, api
+}
+
+func TestExpandMacrosResolvesReferences(t *testing.T) {
+	p, _ := newTestPluginWithMacros(t, "u1", macroSet{"attack": "1d20+5", "sneak": "@attack 2d6"})
+
+	expanded, err := p.expandMacros("u1", "c1", "@sneak")
+	if err != nil {
+		t.Fatalf("expandMacros returned error: %v", err)
+	}
+	if expanded != "1d20+5 2d6" {
+		t.Fatalf("expandMacros(@sneak) = %q, want %q", expanded, "1d20+5 2d6")
+	}
+}
+
+func TestExpandMacrosAllowsDiamondSharedReferences(t *testing.T) {
+	// "combo" references "attack" twice, directly and via "sneak" — a
+	// diamond, not a cycle, since neither branch refers back to itself.
+	p, _ := newTestPluginWithMacros(t, "u1", macroSet{
+		"attack": "1d20+5",
+		"sneak":  "@attack 2d6",
+		"combo":  "@attack @sneak",
+	})
+
+	expanded, err := p.expandMacros("u1", "c1", "@combo")
+	if err != nil {
+		t.Fatalf("expandMacros returned error: %v", err)
+	}
+	if expanded != "1d20+5 1d20+5 2d6" {
+		t.Fatalf("expandMacros(@combo) = %q, want %q", expanded, "1d20+5 1d20+5 2d6")
+	}
+}
+
+func TestExpandMacrosDetectsDirectCycle(t *testing.T) {
+	p, _ := newTestPluginWithMacros(t, "u1", macroSet{"loop": "@loop"})
+
+	if _, err := p.expandMacros("u1", "c1", "@loop"); err == nil {
+		t.Fatalf("expandMacros(@loop) expected a cycle error, got none")
+	}
+}
+
+func TestExpandMacrosDetectsIndirectCycle(t *testing.T) {
+	p, _ := newTestPluginWithMacros(t, "u1", macroSet{"a": "@b", "b": "@a"})
+
+	if _, err := p.expandMacros("u1", "c1", "@a"); err == nil {
+		t.Fatalf("expandMacros(@a) expected a cycle error, got none")
+	}
+}
+
+func TestExpandMacrosUnknownReferencePassesThrough(t *testing.T) {
+	p, _ := newTestPluginWithMacros(t, "u1", macroSet{})
+
+	expanded, err := p.expandMacros("u1", "c1", "4d6")
+	if err != nil {
+		t.Fatalf("expandMacros returned error: %v", err)
+	}
+	if expanded != "4d6" {
+		t.Fatalf("expandMacros(4d6) = %q, want unchanged %q", expanded, "4d6")
+	}
+}
@@ -2,11 +2,9 @@ package main
 
 import (
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
@@ -34,7 +32,7 @@ type Plugin struct {
 }
 
 func (p *Plugin) OnActivate() error {
-	rand.Seed(time.Now().UnixNano())
+	seedFastRNG()
 
 	rollError := p.API.RegisterCommand(&model.Command{
 		Trigger:          trigger,
@@ -85,9 +83,20 @@ func (p *Plugin) GetHelpMessage() *model.CommandResponse {
 		Text: "Here are some examples:\n" +
 			"- `/roll 20` to roll a 20-sided die. You can use any number.\n" +
 			"- `/roll 5D6` to roll five 6-sided dice in one go.\n" +
-			"- `/roll 5D6+3` to roll five 6-sided dice and add 3 the result of each die.\n" +
-			"- `/roll 5D6 +3` (with a space) to roll five 6-sided dice and add 3 the total.\n" +
+			"- `/roll 5D6+3` to roll five 6-sided dice and add 3 to the total (with or without a space before the +3).\n" +
 			"- `/roll 5 d8 13D20` to roll different dice at the same time.\n" +
+			"- `/roll 4d6!` to roll exploding dice (rerolls and adds on a max result).\n" +
+			"- `/roll 4d6kh3` or `/roll 4d6dl1` to keep the highest 3 or drop the lowest 1.\n" +
+			"- `/roll 2d20r1` to reroll (once) any die showing 1 or less.\n" +
+			"- `/roll adv` or `/roll dis` to roll with advantage or disadvantage.\n" +
+			"- `/roll 6d10s8` to roll a success pool, counting dice showing 8 or more.\n" +
+			"- `/roll 4dF` to roll Fate/FUDGE dice.\n" +
+			"- `/roll save attack 1d20+5` to save a roll, then `/roll @attack` or `/roll attack` to use it.\n" +
+			"- `/roll save --channel initiative 1d20+2` to save a roll shared by the whole channel.\n" +
+			"- `/roll list` to list your saved rolls, `/roll unsave attack` to remove one.\n" +
+			"- `/roll round status` to see the current round's standings without closing it.\n" +
+			"- `/close` to close the round and post the leaderboard.\n" +
+			"- `/roll verify <post-id>` to confirm a roll hasn't been tampered with (crypto RNG mode only).\n" +
 			"- `/roll help` will show this help text.\n\n" +
 			" ⚅ ⚂ Let's get rolling! ⚁ ⚄",
 		Props: props,
@@ -115,14 +124,39 @@ func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*mo
 			return p.GetHelpMessage(), nil
 		}
 
-		post, generatePostError := p.generateDicePost(query, args.UserId, args.ChannelId, args.RootId)
+		if handled, response, verifyError := p.handleVerifySubcommand(query, args.ChannelId); handled {
+			return response, verifyError
+		}
+
+		if handled, response, roundError := p.handleRoundSubcommand(query, args.ChannelId); handled {
+			return response, roundError
+		}
+
+		if handled, response, macroError := p.handleMacroSubcommand(query, args.UserId, args.ChannelId); handled {
+			return response, macroError
+		}
+
+		expandedQuery, expandError := p.expandMacros(args.UserId, args.ChannelId, query)
+		if expandError != nil {
+			return nil, expandError
+		}
+
+		post, commitment, pendingRound, generatePostError := p.generateDicePost(expandedQuery, args.UserId, args.ChannelId, args.RootId)
 		if generatePostError != nil {
 			return nil, generatePostError
 		}
-		_, createPostError := p.API.CreatePost(post)
+		createdPost, createPostError := p.API.CreatePost(post)
 		if createPostError != nil {
 			return nil, createPostError
 		}
+		if recordErr := p.recordRoll(args.ChannelId, args.UserId, createdPost.Id, pendingRound.displayName, pendingRound.expression, pendingRound.total, pendingRound.highestDie); recordErr != nil {
+			return nil, recordErr
+		}
+		if commitment != nil {
+			if commitError := p.recordCommitment(args.ChannelId, createdPost.Id, *commitment); commitError != nil {
+				return nil, commitError
+			}
+		}
 
 		validTrigger = true
 	}
@@ -164,6 +198,18 @@ func (p *Plugin) generateClosePost(userID, channelID, rootID string) (*model.Pos
 
 	text := fmt.Sprintf("**Rien ne va plus!!!!**\n_%s closes the round._", displayName)
 
+	round, roundErr := p.loadRound(channelID)
+	if roundErr != nil {
+		return nil, roundErr
+	}
+	if len(round.Entries) > 0 {
+		text += "\n\n" + p.renderLeaderboard(round)
+	}
+
+	if clearErr := p.clearRound(channelID); clearErr != nil {
+		return nil, clearErr
+	}
+
 	return &model.Post{
 		UserId:    p.diceBotID,
 		ChannelId: channelID,
@@ -172,29 +218,20 @@ func (p *Plugin) generateClosePost(userID, channelID, rootID string) (*model.Pos
 	}, nil
 }
 
-func (p *Plugin) generateDicePost(query, userID, channelID, rootID string) (*model.Post, *model.AppError) {
-	// Get the user to display their name
-	user, userErr := p.API.GetUser(userID)
-	if userErr != nil {
-		return nil, userErr
-	}
-	displayName := user.Nickname
-	if displayName == "" {
-		displayName = user.Username
-	}
-
-	if strings.TrimSpace(query) == "" {
-		query = "100"
-	}
-
-	text := fmt.Sprintf("**%s** rolls *%s* = ", displayName, query)
+// evaluateQuery rolls every token of query using roll (normally rollDice,
+// but the interactive-action handlers substitute variants such as
+// rerollLowest) and renders the "**sum**" line generateDicePost and the
+// action handlers both post. It also reports the running total and the
+// single highest die rolled, which the round scorekeeping uses to tell
+// rolls apart and break ties.
+func evaluateQuery(query string, roll func(string) (*rollResult, error)) (text string, total int, highestDie int, err *model.AppError) {
 	sum := 0
+	highest := 0
 	rollRequests := strings.Fields(query)
 	if len(rollRequests) == 0 || query == "sum" {
-		return nil, appError("No roll request arguments found (such as '20', '4d6', etc.).", nil)
+		return "", 0, 0, appError("No roll request arguments found (such as '20', '4d6', etc.).", nil)
 	}
 	singleResultCount := 0
-	numericDiceCount := 0
 	formattedRollDetails := make([]string, len(rollRequests))
 	for i, rollRequest := range rollRequests {
 		// Ignore the 'sum' keyword, remnant of a previous version
@@ -202,27 +239,38 @@ func (p *Plugin) generateDicePost(query, userID, channelID, rootID string) (*mod
 		if rollRequest == "sum" {
 			continue
 		}
-		result, err := rollDice(rollRequest)
-		if err != nil {
-			return nil, appError(fmt.Sprintf("%s See `/roll help` for examples.", err.Error()), err)
+		result, rollErr := roll(rollRequest)
+		if rollErr != nil {
+			return "", 0, 0, appError(fmt.Sprintf("%s See `/roll help` for examples.", rollErr.Error()), rollErr)
+		}
+		for _, die := range result.dice {
+			if die.value > highest {
+				highest = die.value
+			}
 		}
-		if result.rollType == numeric {
-			numericDiceCount++
-			rollDetails := fmt.Sprintf("%s: ", rollRequest)
-			singleResultCount += len(result.results)
+		switch result.rollType {
+		case numeric:
+			singleResultCount += len(result.dice)
+			rollDetails := fmt.Sprintf("%s: %s", rollRequest, formatDice(result.dice))
 			for _, roll := range result.results {
-				rollDetails += fmt.Sprintf("%d ", roll)
 				sum += roll
 			}
+			if result.sumModifier != 0 {
+				rollDetails += fmt.Sprintf(" %+d", result.sumModifier)
+				sum += result.sumModifier
+			}
 			formattedRollDetails[i] = strings.TrimSpace(rollDetails)
-		} else {
+		case pool:
+			singleResultCount += len(result.dice)
+			formattedRollDetails[i] = fmt.Sprintf("%s: %s = %d successes", rollRequest, formatDice(result.dice), result.successes)
+			sum += result.successes
+		default:
 			formattedRollDetails[i] = fmt.Sprintf("%+d", result.sumModifier)
 			sum += result.sumModifier
 		}
 	}
 
-	// Always display the total
-	text += fmt.Sprintf("**%d**", sum)
+	text = fmt.Sprintf("**%d**", sum)
 
 	// Display roll details only of necessary
 	if singleResultCount > 1 {
@@ -230,12 +278,59 @@ func (p *Plugin) generateDicePost(query, userID, channelID, rootID string) (*mod
 		text += fmt.Sprintf("\n- %s", strings.Join(formattedRollDetails, "\n- "))
 	}
 
-	return &model.Post{
+	return text, sum, highest, nil
+}
+
+func (p *Plugin) generateDicePost(query, userID, channelID, rootID string) (*model.Post, *pendingCommitment, *pendingRoundEntry, *model.AppError) {
+	// Get the user to display their name
+	user, userErr := p.API.GetUser(userID)
+	if userErr != nil {
+		return nil, nil, nil, userErr
+	}
+	displayName := user.Nickname
+	if displayName == "" {
+		displayName = user.Username
+	}
+
+	if strings.TrimSpace(query) == "" {
+		query = "100"
+	}
+
+	r, seededWith, rngErr := p.newRNG()
+	if rngErr != nil {
+		return nil, nil, nil, appError(rngErr.Error(), rngErr)
+	}
+
+	var snapshot []tokenSnapshot
+	result, total, highestDie, err := evaluateQuery(query, func(token string) (*rollResult, error) {
+		rolled, rollErr := rollDice(token, r)
+		if rollErr == nil {
+			snapshot = append(snapshot, snapshotToken(token, rolled))
+		}
+		return rolled, rollErr
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	text := fmt.Sprintf("**%s** rolls *%s* = %s", displayName, query, result)
+
+	post := &model.Post{
 		UserId:    p.diceBotID,
 		ChannelId: channelID,
 		RootId:    rootID,
 		Message:   text,
-	}, nil
+	}
+	history := []string{text}
+	post.AddProp("attachments", []*model.SlackAttachment{p.buildRollAttachment(query, userID, channelID, rootID, history, snapshot)})
+
+	var commitment *pendingCommitment
+	if seededWith != nil {
+		commitment = &pendingCommitment{seed: seededWith.seed, expression: query, result: result}
+	}
+	pendingRound := &pendingRoundEntry{displayName: displayName, expression: query, total: total, highestDie: highestDie}
+
+	return post, commitment, pendingRound, nil
 }
 
 func filterEmptyString(arr []string) []string {
@@ -0,0 +1,246 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+// RNG backends selectable via the plugin's RNGBackend configuration setting.
+const (
+	rngBackendFast   = "fast"
+	rngBackendCrypto = "crypto"
+)
+
+// rng is the minimal source of randomness rollDice needs, so the plugin can
+// swap a fast math/rand source for an auditable crypto/rand one without the
+// dice-notation parser knowing the difference.
+type rng interface {
+	// Intn returns a non-negative value in [0, n).
+	Intn(n int) int
+}
+
+// fastRNG draws from the process-wide math/rand source seeded once in
+// seedFastRNG. It's cheap and fine for casual play, but its draws aren't
+// tied to a recorded seed, so a roll made with it can't be committed to or
+// verified later.
+type fastRNG struct{}
+
+func (fastRNG) Intn(n int) int { return mathrand.Intn(n) }
+
+// seedFastRNG seeds the package-level math/rand source the fast backend
+// draws from. Call once, from OnActivate.
+func seedFastRNG() {
+	mathrand.Seed(time.Now().UnixNano())
+}
+
+// cryptoRNG is seeded from crypto/rand for a single roll and remembers that
+// seed so the roll can be committed to (see recordCommitment) and later
+// verified with `/roll verify`.
+type cryptoRNG struct {
+	seed   []byte
+	source *mathrand.Rand
+}
+
+// newCryptoRNG draws a fresh 32-byte seed from crypto/rand and uses it to
+// drive a math/rand source for the roll, so results are reproducible from
+// the seed while still being unpredictable beforehand.
+func newCryptoRNG() (*cryptoRNG, error) {
+	seed := make([]byte, 32)
+	if _, err := cryptorand.Read(seed); err != nil {
+		return nil, fmt.Errorf("could not read a crypto/rand seed: %w", err)
+	}
+
+	return cryptoRNGFromSeed(seed), nil
+}
+
+func (c *cryptoRNG) Intn(n int) int { return c.source.Intn(n) }
+
+// cryptoRNGFromSeed rebuilds the math/rand source a given crypto/rand seed
+// drove, so a stored roll can be replayed deterministically from its seed at
+// verify time. It must derive the source exactly as newCryptoRNG does.
+//
+// math/rand.Source only takes a single int64, so all 32 seed bytes are
+// folded into it rather than just the first 8 — otherwise only a quarter of
+// the "crypto" seed's entropy would actually influence the roll.
+func cryptoRNGFromSeed(seed []byte) *cryptoRNG {
+	var seedInt int64
+	for i, b := range seed {
+		seedInt ^= int64(b) << uint(8*(i%8))
+	}
+	return &cryptoRNG{seed: seed, source: mathrand.New(mathrand.NewSource(seedInt))}
+}
+
+// newRNG picks the RNG backend the server is configured for. It returns the
+// rng to roll with, and — only in crypto mode — the cryptoRNG that rolled
+// it, so the caller can commit to the result once the roll is known.
+func (p *Plugin) newRNG() (rng, *cryptoRNG, error) {
+	if p.getConfiguration().RNGBackend == rngBackendCrypto {
+		c, err := newCryptoRNG()
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, c, nil
+	}
+	return fastRNG{}, nil, nil
+}
+
+// pendingCommitment is a crypto-mode roll waiting to be committed once its
+// post has been created and its ID is known.
+type pendingCommitment struct {
+	seed       []byte
+	expression string
+	result     string
+}
+
+// commitmentRecord is the persisted, auditable form of a crypto-mode roll:
+// its seed, inputs and the hash committing to all of them.
+type commitmentRecord struct {
+	PostID     string `json:"post_id"`
+	Seed       string `json:"seed"`
+	Expression string `json:"expression"`
+	Result     string `json:"result"`
+	Hash       string `json:"hash"`
+}
+
+const commitmentKeyPrefix = "commitments_"
+
+// maxCommitmentLog bounds how many crypto-mode rolls a channel's log keeps,
+// so it can't grow without limit.
+const maxCommitmentLog = 500
+
+// commitmentHash binds a roll's seed, expression and rendered result
+// together so that changing any one of them, after the fact, is detectable.
+func commitmentHash(seed []byte, expression, result string) []byte {
+	h := sha256.New()
+	h.Write(seed)
+	h.Write([]byte(expression))
+	h.Write([]byte(result))
+	return h.Sum(nil)
+}
+
+// recordCommitment commits a crypto-mode roll for postID, once its ID is
+// known. A post already holding a commitment (a reroll) has its record
+// replaced in place rather than appended, so the log can't accumulate stale
+// entries for the same post and `/roll verify` always reflects what the
+// post currently shows.
+func (p *Plugin) recordCommitment(channelID, postID string, pending pendingCommitment) *model.AppError {
+	record := commitmentRecord{
+		PostID:     postID,
+		Seed:       hex.EncodeToString(pending.seed),
+		Expression: pending.expression,
+		Result:     pending.result,
+		Hash:       hex.EncodeToString(commitmentHash(pending.seed, pending.expression, pending.result)),
+	}
+
+	key := commitmentKeyPrefix + channelID
+	data, err := p.API.KVGet(key)
+	if err != nil {
+		return err
+	}
+	var log []commitmentRecord
+	if data != nil {
+		if jsonErr := json.Unmarshal(data, &log); jsonErr != nil {
+			return appError("Stored commitment log is corrupted: "+jsonErr.Error(), jsonErr)
+		}
+	}
+
+	replaced := false
+	for i := range log {
+		if log[i].PostID == postID {
+			log[i] = record
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		log = append(log, record)
+	}
+	if len(log) > maxCommitmentLog {
+		log = log[len(log)-maxCommitmentLog:]
+	}
+
+	encoded, jsonErr := json.Marshal(log)
+	if jsonErr != nil {
+		return appError("Could not encode commitment log: "+jsonErr.Error(), jsonErr)
+	}
+	return p.API.KVSet(key, encoded)
+}
+
+// findCommitment looks up a channel's recorded commitment for postID, if
+// any.
+func (p *Plugin) findCommitment(channelID, postID string) (*commitmentRecord, *model.AppError) {
+	data, err := p.API.KVGet(commitmentKeyPrefix + channelID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var log []commitmentRecord
+	if jsonErr := json.Unmarshal(data, &log); jsonErr != nil {
+		return nil, appError("Stored commitment log is corrupted: "+jsonErr.Error(), jsonErr)
+	}
+	for i := range log {
+		if log[i].PostID == postID {
+			return &log[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// handleVerifySubcommand recognizes `/roll verify <post-id>`: it replays the
+// roll by re-seeding a math/rand source from the recorded seed and
+// re-evaluating the recorded expression through the same dice engine the
+// original roll used, then confirms both the rendered result and the
+// commitment hash still match what was stored at roll time. Recomputing the
+// hash alone would not catch tampering, since the seed, expression and
+// result it's recomputed from live in the same KV record it's meant to
+// protect — replaying the roll is what actually proves the stored result is
+// what that seed produces, rather than just what someone wrote down.
+func (p *Plugin) handleVerifySubcommand(query, channelID string) (bool, *model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 || fields[0] != "verify" {
+		return false, nil, nil
+	}
+	if len(fields) != 2 {
+		return true, nil, appError("Usage: `/roll verify <post-id>`.", nil)
+	}
+	postID := fields[1]
+
+	record, err := p.findCommitment(channelID, postID)
+	if err != nil {
+		return true, nil, err
+	}
+	if record == nil {
+		return true, ephemeralResponse("No crypto-mode commitment found for that post in this channel."), nil
+	}
+
+	seed, decodeErr := hex.DecodeString(record.Seed)
+	if decodeErr != nil {
+		return true, nil, appError("Stored seed is corrupted: "+decodeErr.Error(), decodeErr)
+	}
+
+	replay := cryptoRNGFromSeed(seed)
+	replayedResult, _, _, evalErr := evaluateQuery(record.Expression, func(token string) (*rollResult, error) {
+		return rollDice(token, replay)
+	})
+	if evalErr != nil {
+		return true, ephemeralResponse(fmt.Sprintf("❌ Verification FAILED for `%s` — the recorded expression no longer replays: %s", postID, evalErr.Error())), nil
+	}
+
+	recomputed := hex.EncodeToString(commitmentHash(seed, record.Expression, replayedResult))
+	if replayedResult != record.Result || recomputed != record.Hash {
+		return true, ephemeralResponse(fmt.Sprintf("❌ Verification FAILED for `%s` — replaying the seed does not reproduce the stored result.", postID)), nil
+	}
+	return true, ephemeralResponse(fmt.Sprintf(
+		"✅ Verified: `%s` committed to *%s* = %s (seed `%s`).", postID, record.Expression, record.Result, record.Seed,
+	)), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+)
+
+const roundKeyPrefix = "round_"
+
+// Tie-breaker strategies a server admin can pick for the round leaderboard,
+// see configuration.TieBreaker.
+const (
+	tieBreakerHighestDie = "highest_die"
+	tieBreakerFirstRoll  = "first_roll"
+	tieBreakerRerollOff  = "reroll_off"
+)
+
+// roundEntry is one user's accumulated standing in the currently open round
+// of a channel.
+type roundEntry struct {
+	DisplayName string `json:"display_name"`
+	Expression  string `json:"expression"`
+	Total       int    `json:"total"`
+	HighestDie  int    `json:"highest_die"`
+	Sequence    int    `json:"sequence"`
+
+	// PostTotals remembers what each of this user's posts last contributed
+	// to Total, keyed by post ID. Re-recording a post (a reroll) replaces
+	// its own contribution instead of adding a second one on top.
+	PostTotals map[string]int `json:"post_totals,omitempty"`
+}
+
+// pendingRoundEntry is a roll's contribution to a round, captured before
+// its post has been created and its ID is known, mirroring pendingCommitment.
+type pendingRoundEntry struct {
+	displayName string
+	expression  string
+	total       int
+	highestDie  int
+}
+
+// round is the scorekeeping state kept in the KV store for a channel
+// between two `/close` calls, keyed by the rolling user's ID.
+type round struct {
+	Entries map[string]*roundEntry `json:"entries"`
+	NextSeq int                    `json:"next_seq"`
+}
+
+func (p *Plugin) loadRound(channelID string) (*round, *model.AppError) {
+	data, err := p.API.KVGet(roundKeyPrefix + channelID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return &round{Entries: map[string]*roundEntry{}}, nil
+	}
+
+	r := &round{}
+	if jsonErr := json.Unmarshal(data, r); jsonErr != nil {
+		return nil, appError("Stored round is corrupted: "+jsonErr.Error(), jsonErr)
+	}
+	if r.Entries == nil {
+		r.Entries = map[string]*roundEntry{}
+	}
+	return r, nil
+}
+
+func (p *Plugin) saveRound(channelID string, r *round) *model.AppError {
+	data, jsonErr := json.Marshal(r)
+	if jsonErr != nil {
+		return appError("Could not encode round: "+jsonErr.Error(), jsonErr)
+	}
+	return p.API.KVSet(roundKeyPrefix+channelID, data)
+}
+
+func (p *Plugin) clearRound(channelID string) *model.AppError {
+	return p.API.KVDelete(roundKeyPrefix + channelID)
+}
+
+// recordRoll folds one post's roll into the channel's open round, opening a
+// new round if none is in progress. A user's total accumulates across every
+// distinct post they roll on in the round; re-recording the same postID (a
+// reroll replacing that post's result) replaces its prior contribution
+// instead of adding a second one. Their highest single die and most recent
+// expression are kept for display and tie-breaking.
+func (p *Plugin) recordRoll(channelID, userID, postID, displayName, expression string, total, highestDie int) *model.AppError {
+	r, err := p.loadRound(channelID)
+	if err != nil {
+		return err
+	}
+
+	entry, ok := r.Entries[userID]
+	if !ok {
+		entry = &roundEntry{Sequence: r.NextSeq}
+		r.NextSeq++
+		r.Entries[userID] = entry
+	}
+	if entry.PostTotals == nil {
+		entry.PostTotals = map[string]int{}
+	}
+	entry.Total -= entry.PostTotals[postID]
+	entry.Total += total
+	entry.PostTotals[postID] = total
+
+	entry.DisplayName = displayName
+	entry.Expression = expression
+	if highestDie > entry.HighestDie {
+		entry.HighestDie = highestDie
+	}
+
+	return p.saveRound(channelID, r)
+}
+
+// handleRoundSubcommand recognizes `/roll round status` so players can peek
+// at the current standings without closing the round.
+func (p *Plugin) handleRoundSubcommand(query, channelID string) (bool, *model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 || fields[0] != "round" {
+		return false, nil, nil
+	}
+	if len(fields) != 2 || fields[1] != "status" {
+		return true, nil, appError("Usage: `/roll round status`.", nil)
+	}
+
+	r, err := p.loadRound(channelID)
+	if err != nil {
+		return true, nil, err
+	}
+	if len(r.Entries) == 0 {
+		return true, ephemeralResponse("No rolls recorded yet this round."), nil
+	}
+	return true, ephemeralResponse(p.renderLeaderboard(r)), nil
+}
+
+// renderLeaderboard ranks a round's entries by total, breaking ties
+// according to the server's configured tie-breaker, and renders them as a
+// medal-decorated markdown list.
+func (p *Plugin) renderLeaderboard(r *round) string {
+	entries := make([]*roundEntry, 0, len(r.Entries))
+	for _, entry := range r.Entries {
+		entries = append(entries, entry)
+	}
+
+	tieBreaker := p.getConfiguration().TieBreaker
+	if tieBreaker == "" {
+		tieBreaker = tieBreakerHighestDie
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Total != entries[j].Total {
+			return entries[i].Total > entries[j].Total
+		}
+		switch tieBreaker {
+		case tieBreakerFirstRoll:
+			return entries[i].Sequence < entries[j].Sequence
+		case tieBreakerRerollOff:
+			return entries[i].DisplayName < entries[j].DisplayName
+		default:
+			return entries[i].HighestDie > entries[j].HighestDie
+		}
+	})
+
+	medals := []string{"🥇", "🥈", "🥉"}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		medal := "🏅"
+		if i < len(medals) {
+			medal = medals[i]
+		}
+		lines[i] = fmt.Sprintf("%s %s — %d (*%s*)", medal, entry.DisplayName, entry.Total, entry.Expression)
+	}
+
+	text := strings.Join(lines, "\n")
+	if tieBreaker == tieBreakerRerollOff && len(entries) > 1 && entries[0].Total == entries[1].Total {
+		text += fmt.Sprintf("\n\n_%s and %s are tied — roll again to settle it!_", entries[0].DisplayName, entries[1].DisplayName)
+	}
+	return text
+}